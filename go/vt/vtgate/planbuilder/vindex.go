@@ -6,6 +6,8 @@ package planbuilder
 
 import (
 	"fmt"
+	"sort"
+	"sync"
 
 	"github.com/youtube/vitess/go/sqltypes"
 )
@@ -17,11 +19,29 @@ import (
 // can use this interface to execute lookup queries.
 type VCursor interface {
 	Execute(query string, bindvars map[string]interface{}) (*sqltypes.Result, error)
+
+	// ExecuteBatch executes the given queries in a single round
+	// trip. It's used by Lookup vindexes to resolve large IN (...)
+	// lists without issuing one query per id. Results are returned
+	// in the same order as the queries. A single query failing does
+	// not necessarily fail the others; check each result's error.
+	// Implementations must be safe to call concurrently: helpers
+	// like BatchLookupMap issue multiple ExecuteBatch calls from
+	// separate goroutines to bound fan-out parallelism.
+	ExecuteBatch(queries []BoundQuery) ([]*sqltypes.Result, error)
+}
+
+// A BoundQuery is a query with its bind variables, suitable for
+// batch execution through VCursor.ExecuteBatch.
+type BoundQuery struct {
+	Sql           string
+	BindVariables map[string]interface{}
 }
 
 // Vindex defines the interface required to register a vindex.
-// Additional to these functions, a vindex also needs
-// to satisfy the Unique or NonUnique interface.
+// Additional to these functions, a vindex also needs to satisfy
+// the Unique or NonUnique interface, and either SingleColumn or
+// MultiColumn, to be usable by planbuilder.
 type Vindex interface {
 	// String returns the name of the Vindex instance.
 	// It's used for testing and diagnostics. Use pointer
@@ -35,9 +55,17 @@ type Vindex interface {
 	// from an external data source. These guidelines are subject
 	// to change in the future.
 	Cost() int
+}
 
-	// Verify must be implented by all vindexes. It should return
-	// true if the id can be mapped to the keyspace id.
+// SingleColumn defines the interface for a vindex that maps a
+// single column to a keyspace id. This is the contract the
+// built-in vindexes implement; see MultiColumn for vindexes that
+// map a tuple of columns instead.
+type SingleColumn interface {
+	Vindex
+
+	// Verify must be implemented by all single-column vindexes. It
+	// should return true if the id can be mapped to the keyspace id.
 	Verify(cursor VCursor, id interface{}, ks []byte) (bool, error)
 }
 
@@ -85,9 +113,158 @@ type Functional interface {
 // A Lookup vindex need not be unique because the
 // keyspace_id, which must be supplied, can be used
 // to determine the target shard for an insert operation.
+//
+// Map and Verify on a Lookup vindex are expected to resolve their
+// ids through cursor.ExecuteBatch rather than issuing one
+// cursor.Execute per id. DefaultLookupParallelism caps how many
+// queries go into one ExecuteBatch call and how many of those calls
+// a Lookup implementation should have in flight at once; vindexes
+// that take a "parallelism" param should use that value instead.
+//
+// Create, Delete and Update must all run their queries on the
+// VCursor passed in by the caller, and must not open or commit a
+// transaction of their own: the caller is expected to have one
+// open already, and the lookup row changes only become durable
+// when that outer transaction commits. This lets a DML that
+// changes both the base table and the lookup row roll back
+// atomically if either write fails.
+//
+// If the vindex was created with a cache (see Cacheable), the
+// wrapper CreateVindex returns invalidates the affected id(s) after
+// Create, Delete and Update return successfully, so a later
+// Map/Verify doesn't serve a resolution the write just changed.
 type Lookup interface {
 	Create(VCursor, interface{}, []byte) error
 	Delete(VCursor, []interface{}, []byte) error
+
+	// Update changes the lookup row for a single id in place: it
+	// must behave as if Delete(cursor, []interface{}{oldID}, ks)
+	// followed by Create(cursor, newID, ks) ran atomically within
+	// the caller's transaction. Vindexes for which oldId and newId
+	// hash to the same underlying row may implement this as a
+	// single UPDATE statement instead of a delete+insert pair.
+	Update(cursor VCursor, oldID interface{}, newID interface{}, ks []byte) error
+}
+
+// DefaultLookupParallelism is the fan-out concurrency a Lookup
+// vindex should use to resolve a batch of ids when its params
+// don't specify a "parallelism" override.
+const DefaultLookupParallelism = 4
+
+// BatchLookupMap is the shared helper built-in Lookup vindexes use
+// to implement Unique.Map/NonUnique.Map: instead of calling
+// cursor.Execute once per id, it splits queries into chunks of at
+// most parallelism entries and issues one cursor.ExecuteBatch per
+// chunk, running at most parallelism chunks concurrently. Results
+// are returned in
+// the same order as queries. parallelism <= 0 uses
+// DefaultLookupParallelism.
+func BatchLookupMap(cursor VCursor, queries []BoundQuery, parallelism int) ([]*sqltypes.Result, error) {
+	if parallelism <= 0 {
+		parallelism = DefaultLookupParallelism
+	}
+	results := make([]*sqltypes.Result, len(queries))
+	errs := make([]error, len(queries)/parallelism+1)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallelism)
+	for start := 0; start < len(queries); start += parallelism {
+		end := start + parallelism
+		if end > len(queries) {
+			end = len(queries)
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(start, end int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			chunk, err := cursor.ExecuteBatch(queries[start:end])
+			if err != nil {
+				errs[start/parallelism] = err
+				return
+			}
+			copy(results[start:end], chunk)
+		}(start, end)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// A MultiColumn vindex maps a tuple of columns, rather than a
+// single column, to a keyspace id. It's used for predicates like
+// (a, b) IN ((1, 2), (3, 4)), where the planbuilder would otherwise
+// have no choice but to scatter. A MultiColumn vindex is registered
+// and costed like any other Vindex, but planbuilder only routes a
+// WHERE clause through it when the predicate supplies values for
+// every column the vindex expects, in order.
+//
+// Cost needs no MultiColumn-specific handling: it's the same
+// per-vindex cost every Vindex reports through the embedded Vindex
+// interface below, whether it maps one column or a tuple of them.
+// IsUnique has no MultiColumn-specific handling either: it
+// type-asserts on Unique, whose Map takes []interface{}, and a type
+// can't also have the MultiColumn Map below, so IsUnique (and the
+// Unique field of DescribeVindex) reports false for every
+// MultiColumn vindex, even though its Map returns one keyspace id
+// per rowid.
+type MultiColumn interface {
+	Vindex
+
+	// Columns returns the ordered list of columns this vindex maps.
+	// A predicate must bind all of them for the vindex to apply.
+	Columns() []string
+
+	// Map returns the keyspace ids for the given rowids. Each rowid
+	// is a tuple with one value per column, in Columns order.
+	Map(cursor VCursor, rowids [][]interface{}) ([][]byte, error)
+
+	// Verify returns, for each rowid/keyspace id pair, whether the
+	// rowid can map to that keyspace id.
+	Verify(cursor VCursor, rowids [][]interface{}, ks [][]byte) ([]bool, error)
+}
+
+// IsMultiColumn returns true if the Vindex is a MultiColumn vindex.
+func IsMultiColumn(v Vindex) bool {
+	_, ok := v.(MultiColumn)
+	return ok
+}
+
+// MapMultiColumnPredicate is the entry point the route/DML
+// planbuilder calls for a WHERE predicate of the form
+// (a, b, ...) IN ((1, 2, ...), ...): it routes rowids through v if
+// v is a MultiColumn vindex covering exactly those columns, so the
+// caller never has to fall back to a scatter query for a predicate
+// a composite vindex could have resolved directly. ok is false
+// when v isn't a MultiColumn vindex, or when cols doesn't match
+// v.Columns() (order matters, since Map/Verify address each rowid
+// tuple positionally); either case tells the caller to fall back
+// to scatter.
+func MapMultiColumnPredicate(v Vindex, cursor VCursor, cols []string, rowids [][]interface{}) (ks [][]byte, ok bool, err error) {
+	mc, ok := v.(MultiColumn)
+	if !ok {
+		return nil, false, nil
+	}
+	if !sameColumns(mc.Columns(), cols) {
+		return nil, false, nil
+	}
+	ks, err = mc.Map(cursor, rowids)
+	return ks, true, err
+}
+
+func sameColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // A NewVindexFunc is a function that creates a Vindex based on the
@@ -95,25 +272,145 @@ type Lookup interface {
 // register a NewVindexFunc under a unique vindexType.
 type NewVindexFunc func(string, map[string]interface{}) (Vindex, error)
 
-var registry = make(map[string]NewVindexFunc)
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]NewVindexFunc)
+)
 
 // Register registers a vindex under the specified vindexType.
 // A duplicate vindexType will generate a panic.
 // New vindexes will be created using these functions at the
 // time of vschema loading.
 func Register(vindexType string, newVindexFunc NewVindexFunc) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
 	if _, ok := registry[vindexType]; ok {
 		panic(fmt.Sprintf("%s is already registered", vindexType))
 	}
 	registry[vindexType] = newVindexFunc
 }
 
+// Unregister removes vindexType from the registry. It's a no-op if
+// vindexType was never registered. Existing Vindex instances built
+// from it keep working; only future CreateVindex calls are
+// affected.
+func Unregister(vindexType string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	delete(registry, vindexType)
+}
+
+// ReplaceVindexFunc swaps the NewVindexFunc registered under
+// vindexType, unlike Register, which panics on a duplicate. It
+// returns an error if vindexType was never registered, so it can't
+// be used to sneak in a new vindexType outside of Register. This
+// lets an operator hot-swap a vindex implementation (e.g. to roll
+// out a bug fix) without restarting vtgate.
+func ReplaceVindexFunc(vindexType string, newVindexFunc NewVindexFunc) error {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[vindexType]; !ok {
+		return fmt.Errorf("vindexType %s not found", vindexType)
+	}
+	registry[vindexType] = newVindexFunc
+	return nil
+}
+
+// RegisteredVindexTypes returns the sorted list of vindexTypes
+// currently registered.
+func RegisteredVindexTypes() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	types := make([]string, 0, len(registry))
+	for vindexType := range registry {
+		types = append(types, vindexType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// VindexInfo describes the shape of a registered vindex type, for
+// admin tooling that wants to introspect the registry without
+// building a real vindex against a live vschema.
+type VindexInfo struct {
+	Type        string
+	Cost        int
+	Unique      bool
+	Reversible  bool
+	MultiColumn bool
+}
+
+// DescribeVindex returns a VindexInfo for vindexType. It does so
+// by constructing a probe instance with no params, so it only
+// reports accurate Cost/Unique/Reversible/MultiColumn values for
+// vindex types that don't require params to construct (e.g.
+// functional vindexes like hash or numeric); a vindexType that
+// needs params (most Lookup vindexes) returns an error naming the
+// vindexType, which is itself useful for admin tooling that just
+// wants to confirm the type is registered.
+func DescribeVindex(vindexType string) (VindexInfo, error) {
+	registryMu.Lock()
+	f, ok := registry[vindexType]
+	registryMu.Unlock()
+	if !ok {
+		return VindexInfo{}, fmt.Errorf("vindexType %s not found", vindexType)
+	}
+	v, err := f(vindexType, map[string]interface{}{})
+	if err != nil {
+		return VindexInfo{}, fmt.Errorf("vindexType %s: %v", vindexType, err)
+	}
+	_, reversible := v.(Reversible)
+	return VindexInfo{
+		Type:        vindexType,
+		Cost:        v.Cost(),
+		Unique:      IsUnique(v),
+		Reversible:  reversible,
+		MultiColumn: IsMultiColumn(v),
+	}, nil
+}
+
 // CreateVindex creates a vindex of the specified type using the
 // supplied params. The type must have been previously registered.
+//
+// If params contains a "cache" block (e.g. {"cache": {"backend":
+// "lru", "size": 10000}}) and the resulting vindex is Cacheable,
+// Unique and SingleColumn, it's wrapped so Map and Verify consult
+// the cache before using the VCursor. The "backend" key selects
+// among caches registered with RegisterVindexCache and defaults to
+// "lru".
 func CreateVindex(vindexType, name string, params map[string]interface{}) (Vindex, error) {
+	registryMu.Lock()
 	f, ok := registry[vindexType]
+	registryMu.Unlock()
 	if !ok {
 		return nil, fmt.Errorf("vindexType %s not found", vindexType)
 	}
-	return f(name, params)
+	v, err := f(name, params)
+	if err != nil {
+		return nil, err
+	}
+	cacheParams, ok := params["cache"].(map[string]interface{})
+	if !ok {
+		return v, nil
+	}
+	cacheable, ok := v.(Cacheable)
+	if !ok {
+		return v, nil
+	}
+	backend, _ := cacheParams["backend"].(string)
+	if backend == "" {
+		backend = "lru"
+	}
+	newCache, ok := cacheRegistry[backend]
+	if !ok {
+		return nil, fmt.Errorf("vindex cache backend %s not found", backend)
+	}
+	cache, err := newCache(cacheParams)
+	if err != nil {
+		return nil, fmt.Errorf("%s: creating cache for vindex %s: %v", vindexType, name, err)
+	}
+	if wrapped, ok := newCachingVindex(v, cacheable, cache); ok {
+		return wrapped, nil
+	}
+	return v, nil
 }
@@ -0,0 +1,86 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package planbuilder
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+// countingBatchVCursor counts how many queries reach ExecuteBatch
+// per call, so tests can check chunking without depending on
+// timing. BatchLookupMap calls ExecuteBatch from multiple
+// goroutines, so batches is guarded by mu.
+type countingBatchVCursor struct {
+	mu      sync.Mutex
+	batches [][]BoundQuery
+}
+
+func (c *countingBatchVCursor) Execute(query string, bindvars map[string]interface{}) (*sqltypes.Result, error) {
+	return &sqltypes.Result{}, nil
+}
+
+func (c *countingBatchVCursor) ExecuteBatch(queries []BoundQuery) ([]*sqltypes.Result, error) {
+	c.mu.Lock()
+	c.batches = append(c.batches, queries)
+	c.mu.Unlock()
+	results := make([]*sqltypes.Result, len(queries))
+	for i := range queries {
+		results[i] = &sqltypes.Result{}
+	}
+	return results, nil
+}
+
+func TestBatchLookupMapPreservesOrder(t *testing.T) {
+	queries := []BoundQuery{
+		{Sql: "select 1"},
+		{Sql: "select 2"},
+		{Sql: "select 3"},
+		{Sql: "select 4"},
+		{Sql: "select 5"},
+	}
+	cursor := &countingBatchVCursor{}
+	results, err := BatchLookupMap(cursor, queries, 2)
+	if err != nil {
+		t.Fatalf("BatchLookupMap: %v", err)
+	}
+	if len(results) != len(queries) {
+		t.Fatalf("got %d results, want %d", len(results), len(queries))
+	}
+	for i, r := range results {
+		if r == nil {
+			t.Errorf("results[%d] is nil", i)
+		}
+	}
+}
+
+func TestBatchLookupMapChunksByParallelism(t *testing.T) {
+	queries := make([]BoundQuery, 5)
+	cursor := &countingBatchVCursor{}
+	if _, err := BatchLookupMap(cursor, queries, 2); err != nil {
+		t.Fatalf("BatchLookupMap: %v", err)
+	}
+	if len(cursor.batches) != 3 {
+		t.Fatalf("got %d ExecuteBatch calls, want 3 chunks of at most 2 queries each for 5 queries", len(cursor.batches))
+	}
+	for _, b := range cursor.batches {
+		if len(b) > 2 {
+			t.Errorf("chunk of size %d exceeds parallelism 2", len(b))
+		}
+	}
+}
+
+func TestBatchLookupMapDefaultsParallelism(t *testing.T) {
+	queries := make([]BoundQuery, DefaultLookupParallelism+1)
+	cursor := &countingBatchVCursor{}
+	if _, err := BatchLookupMap(cursor, queries, 0); err != nil {
+		t.Fatalf("BatchLookupMap: %v", err)
+	}
+	if len(cursor.batches) != 2 {
+		t.Fatalf("got %d ExecuteBatch calls, want 2 chunks when parallelism <= 0 falls back to DefaultLookupParallelism", len(cursor.batches))
+	}
+}
@@ -0,0 +1,371 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package planbuilder
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// This file adds an optional caching layer in front of Unique,
+// SingleColumn vindexes (the shape a typical Lookup vindex takes).
+// It's aimed at hot lookup workloads where the same ids are
+// resolved over and over: CreateVindex wraps such a vindex so its
+// Map and Verify consult the cache before ever reaching the
+// VCursor, and populate it with both positive and negative results.
+
+// A Cacheable vindex opts into the caching layer. CreateVindex
+// checks for this interface after building the underlying vindex;
+// a vindex that doesn't implement it is never wrapped, regardless
+// of whether a "cache" param block was supplied.
+type Cacheable interface {
+	// CacheKey returns the string under which id's resolution
+	// should be cached. Most vindexes can just fmt.Sprint the id;
+	// it's a separate method so a vindex can normalize ids that
+	// compare equal but aren't identical (e.g. numeric vs string).
+	CacheKey(id interface{}) string
+
+	// TTL is how long a cache entry for this vindex stays valid.
+	// A TTL of 0 means entries never expire on their own and are
+	// only removed by eviction or explicit invalidation.
+	TTL() time.Duration
+}
+
+// A VindexCache stores id -> keyspace id resolutions for a single
+// vindex. Implementations must be safe for concurrent use. The
+// built-in vindex package only ships the in-process LRU below, but
+// the interface lets an operator plug in an external backend
+// (e.g. memcached) by registering a constructor with
+// RegisterVindexCache.
+type VindexCache interface {
+	// Get returns the cached keyspace id for key, or ok == false on
+	// a miss. A cached negative result (the id doesn't exist) is
+	// reported as ok == true with a nil ks.
+	Get(key string) (ks []byte, ok bool)
+
+	// Set records a resolution for key. A nil ks records a
+	// negative result.
+	Set(key string, ks []byte, ttl time.Duration)
+
+	// Invalidate drops any cached entry for key. It's called on
+	// Lookup.Create, Lookup.Delete and Lookup.Update so a cache
+	// never serves a resolution the backing store has since
+	// changed.
+	Invalidate(key string)
+}
+
+// VindexCacheFunc builds a VindexCache from the "cache" param
+// block passed to CreateVindex (e.g. {"size": 10000}). The default
+// registration, "lru", builds the in-process cache below.
+type VindexCacheFunc func(params map[string]interface{}) (VindexCache, error)
+
+var cacheRegistry = map[string]VindexCacheFunc{
+	"lru": newLRUVindexCacheFromParams,
+}
+
+// RegisterVindexCache registers a VindexCache backend under name
+// so it can be selected from a vindex's "cache" param block via
+// {"backend": name}. A duplicate name generates a panic, matching
+// Register's behavior for vindex types.
+func RegisterVindexCache(name string, f VindexCacheFunc) {
+	if _, ok := cacheRegistry[name]; ok {
+		panic(name + " is already registered as a vindex cache backend")
+	}
+	cacheRegistry[name] = f
+}
+
+func newLRUVindexCacheFromParams(params map[string]interface{}) (VindexCache, error) {
+	size := 10000
+	if v, ok := params["size"]; ok {
+		n, err := intParam(v)
+		if err != nil {
+			return nil, fmt.Errorf("cache size: %v", err)
+		}
+		if n <= 0 {
+			return nil, fmt.Errorf("cache size must be positive, got %d", n)
+		}
+		size = n
+	}
+	return newLRUVindexCache(size), nil
+}
+
+// intParam coerces a param value to an int. Vschema params are
+// almost always JSON-decoded before reaching CreateVindex, so a
+// plain number arrives as float64 (or json.Number, if the decoder
+// was configured with UseNumber); v.(int) alone would silently
+// drop any operator-supplied value.
+func intParam(v interface{}) (int, error) {
+	switch n := v.(type) {
+	case int:
+		return n, nil
+	case int64:
+		return int(n), nil
+	case float64:
+		return int(n), nil
+	case json.Number:
+		i, err := n.Int64()
+		if err != nil {
+			return 0, err
+		}
+		return int(i), nil
+	default:
+		return 0, fmt.Errorf("expected a number, got %T", v)
+	}
+}
+
+// cachingVindex wraps a Unique, SingleColumn vindex that also
+// implements Cacheable. This is the shape of a typical unique
+// Lookup vindex, which is the case the cache is meant for. Map and
+// Verify are overridden to consult the cache first and populate it
+// from the wrapped vindex: Map caches every result, including nil
+// (negative) ones, while Verify caches only a true answer, since a
+// false one doesn't tell whether the id exists. String and Cost are
+// promoted unchanged from the embedded vindex.
+//
+// cachingVindex itself does not implement Lookup or Reversible: a
+// wrapper struct promotes methods from its embedded fields whether
+// or not the concrete value backing them is nil, so a field of
+// type Lookup embedded unconditionally would make every
+// cachingVindex satisfy v.(Lookup), even when the wrapped vindex
+// isn't one. newCachingVindex instead picks the concrete wrapper
+// type below (cachingVindex, cachingLookupVindex,
+// cachingReversibleVindex or cachingLookupReversibleVindex)
+// matching exactly the optional interfaces v implements, so a
+// downstream v.(Lookup) or v.(Reversible) assertion sees the same
+// answer it would have seen on the unwrapped vindex.
+type cachingVindex struct {
+	Unique
+	SingleColumn
+	cacheable Cacheable
+	cache     VindexCache
+}
+
+// cachingLookup implements Lookup on behalf of the caching wrapper
+// types below: it forwards Create/Delete/Update to the wrapped
+// vindex and, only once the underlying call succeeds, invalidates
+// the affected id(s) via invalidateCache so a later Map/Verify
+// doesn't serve a resolution the write just changed.
+type cachingLookup struct {
+	lookup Lookup
+	cv     *cachingVindex
+}
+
+func (cl cachingLookup) Create(cursor VCursor, id interface{}, ks []byte) error {
+	if err := cl.lookup.Create(cursor, id, ks); err != nil {
+		return err
+	}
+	invalidateCache(cl.cv, id)
+	return nil
+}
+
+func (cl cachingLookup) Delete(cursor VCursor, ids []interface{}, ks []byte) error {
+	if err := cl.lookup.Delete(cursor, ids, ks); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		invalidateCache(cl.cv, id)
+	}
+	return nil
+}
+
+func (cl cachingLookup) Update(cursor VCursor, oldID interface{}, newID interface{}, ks []byte) error {
+	if err := cl.lookup.Update(cursor, oldID, newID, ks); err != nil {
+		return err
+	}
+	invalidateCache(cl.cv, oldID)
+	invalidateCache(cl.cv, newID)
+	return nil
+}
+
+// cachingLookupVindex is a cachingVindex whose wrapped vindex is
+// also a Lookup.
+type cachingLookupVindex struct {
+	*cachingVindex
+	cachingLookup
+}
+
+// cachingReversibleVindex is a cachingVindex whose wrapped vindex
+// is also Reversible.
+type cachingReversibleVindex struct {
+	*cachingVindex
+	Reversible
+}
+
+// cachingLookupReversibleVindex is a cachingVindex whose wrapped
+// vindex is both a Lookup and Reversible.
+type cachingLookupReversibleVindex struct {
+	*cachingVindex
+	cachingLookup
+	Reversible
+}
+
+func newCachingVindex(v Vindex, cacheable Cacheable, cache VindexCache) (Vindex, bool) {
+	unique, ok := v.(Unique)
+	if !ok {
+		return v, false
+	}
+	single, ok := v.(SingleColumn)
+	if !ok {
+		return v, false
+	}
+	cv := &cachingVindex{Unique: unique, SingleColumn: single, cacheable: cacheable, cache: cache}
+	lookup, isLookup := v.(Lookup)
+	reversible, isReversible := v.(Reversible)
+	switch {
+	case isLookup && isReversible:
+		return &cachingLookupReversibleVindex{cachingVindex: cv, cachingLookup: cachingLookup{lookup: lookup, cv: cv}, Reversible: reversible}, true
+	case isLookup:
+		return &cachingLookupVindex{cachingVindex: cv, cachingLookup: cachingLookup{lookup: lookup, cv: cv}}, true
+	case isReversible:
+		return &cachingReversibleVindex{cachingVindex: cv, Reversible: reversible}, true
+	default:
+		return cv, true
+	}
+}
+
+func (cv *cachingVindex) Map(cursor VCursor, ids []interface{}) ([][]byte, error) {
+	out := make([][]byte, len(ids))
+	var misses []interface{}
+	var missIdx []int
+	for i, id := range ids {
+		if ks, ok := cv.cache.Get(cv.cacheable.CacheKey(id)); ok {
+			out[i] = ks
+			continue
+		}
+		misses = append(misses, id)
+		missIdx = append(missIdx, i)
+	}
+	if len(misses) == 0 {
+		return out, nil
+	}
+	resolved, err := cv.Unique.Map(cursor, misses)
+	if err != nil {
+		return nil, err
+	}
+	for j, idx := range missIdx {
+		out[idx] = resolved[j]
+		cv.cache.Set(cv.cacheable.CacheKey(misses[j]), resolved[j], cv.cacheable.TTL())
+	}
+	return out, nil
+}
+
+func (cv *cachingVindex) Verify(cursor VCursor, id interface{}, ks []byte) (bool, error) {
+	key := cv.cacheable.CacheKey(id)
+	if cached, ok := cv.cache.Get(key); ok {
+		return cached != nil && string(cached) == string(ks), nil
+	}
+	ok, err := cv.SingleColumn.Verify(cursor, id, ks)
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		cv.cache.Set(key, ks, cv.cacheable.TTL())
+	}
+	return ok, nil
+}
+
+// cacheInvalidator is implemented by *cachingVindex and, by
+// promotion, by every wrapper type in this file that embeds it
+// (cachingLookupVindex, cachingReversibleVindex and
+// cachingLookupReversibleVindex), regardless of which optional
+// interfaces the wrapped vindex also satisfies.
+type cacheInvalidator interface {
+	invalidate(id interface{})
+}
+
+func (cv *cachingVindex) invalidate(id interface{}) {
+	cv.cache.Invalidate(cv.cacheable.CacheKey(id))
+}
+
+// invalidateCache drops id's cache entry, if v is one of the
+// caching wrapper types. cachingLookup calls this from Create,
+// Delete and Update once the underlying vindex call has succeeded,
+// so a subsequent Map/Verify doesn't serve a stale resolution. It
+// takes a Vindex rather than a *cachingVindex so it's also safe to
+// call with a vindex that was never wrapped for caching, which is
+// a no-op.
+func invalidateCache(v Vindex, id interface{}) {
+	if ci, ok := v.(cacheInvalidator); ok {
+		ci.invalidate(id)
+	}
+}
+
+// lruVindexCache is the default in-process VindexCache. It evicts
+// the least recently used entry once size is exceeded; TTLs are
+// checked lazily on Get.
+type lruVindexCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key       string
+	ks        []byte
+	expiresAt time.Time
+	hasTTL    bool
+}
+
+func newLRUVindexCache(size int) *lruVindexCache {
+	return &lruVindexCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *lruVindexCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*lruEntry)
+	if entry.hasTTL && time.Now().After(entry.expiresAt) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return entry.ks, true
+}
+
+func (c *lruVindexCache) Set(key string, ks []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &lruEntry{key: key, ks: ks}
+	if ttl > 0 {
+		entry.hasTTL = true
+		entry.expiresAt = time.Now().Add(ttl)
+	}
+	if el, ok := c.items[key]; ok {
+		el.Value = entry
+		c.ll.MoveToFront(el)
+		return
+	}
+	el := c.ll.PushFront(entry)
+	c.items[key] = el
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*lruEntry).key)
+		}
+	}
+}
+
+func (c *lruVindexCache) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+}
@@ -0,0 +1,339 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package planbuilder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUVindexCacheGetSetInvalidate(t *testing.T) {
+	c := newLRUVindexCache(10)
+	if _, ok := c.Get("a"); ok {
+		t.Fatalf("Get on an empty cache returned ok=true")
+	}
+	c.Set("a", []byte("ks-a"), 0)
+	got, ok := c.Get("a")
+	if !ok || string(got) != "ks-a" {
+		t.Fatalf("Get(%q) = %q, %v, want %q, true", "a", got, ok, "ks-a")
+	}
+	c.Invalidate("a")
+	if _, ok := c.Get("a"); ok {
+		t.Fatalf("Get after Invalidate returned ok=true")
+	}
+}
+
+func TestLRUVindexCacheNegativeCaching(t *testing.T) {
+	c := newLRUVindexCache(10)
+	c.Set("missing", nil, 0)
+	got, ok := c.Get("missing")
+	if !ok || got != nil {
+		t.Fatalf("Get(%q) = %v, %v, want nil, true", "missing", got, ok)
+	}
+}
+
+func TestLRUVindexCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLRUVindexCache(2)
+	c.Set("a", []byte("1"), 0)
+	c.Set("b", []byte("2"), 0)
+	// Touching a makes b the least recently used entry.
+	c.Get("a")
+	c.Set("c", []byte("3"), 0)
+
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("least recently used entry %q was not evicted", "b")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Errorf("recently touched entry %q was evicted", "a")
+	}
+	if _, ok := c.Get("c"); !ok {
+		t.Errorf("newly inserted entry %q is missing", "c")
+	}
+}
+
+func TestLRUVindexCacheTTLExpiry(t *testing.T) {
+	c := newLRUVindexCache(10)
+	c.Set("a", []byte("1"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("entry past its TTL was still served")
+	}
+}
+
+func TestLRUVindexCacheZeroTTLNeverExpires(t *testing.T) {
+	c := newLRUVindexCache(10)
+	c.Set("a", []byte("1"), 0)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.Get("a"); !ok {
+		t.Errorf("entry with a zero TTL expired")
+	}
+}
+
+func TestNewLRUVindexCacheFromParamsAcceptsFloat64Size(t *testing.T) {
+	// Vschema params are JSON-decoded before reaching CreateVindex,
+	// so a plain number in the "cache" block arrives as float64.
+	cache, err := newLRUVindexCacheFromParams(map[string]interface{}{"size": float64(3)})
+	if err != nil {
+		t.Fatalf("newLRUVindexCacheFromParams: %v", err)
+	}
+	lru, ok := cache.(*lruVindexCache)
+	if !ok {
+		t.Fatalf("cache is a %T, want *lruVindexCache", cache)
+	}
+	if lru.size != 3 {
+		t.Errorf("size = %d, want 3", lru.size)
+	}
+}
+
+func TestNewLRUVindexCacheFromParamsDefaultsSize(t *testing.T) {
+	cache, err := newLRUVindexCacheFromParams(map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("newLRUVindexCacheFromParams: %v", err)
+	}
+	if cache.(*lruVindexCache).size != 10000 {
+		t.Errorf("size = %d, want the default of 10000", cache.(*lruVindexCache).size)
+	}
+}
+
+func TestNewLRUVindexCacheFromParamsRejectsNonPositiveSize(t *testing.T) {
+	if _, err := newLRUVindexCacheFromParams(map[string]interface{}{"size": float64(0)}); err == nil {
+		t.Errorf("expected an error for a zero cache size, got nil")
+	}
+}
+
+// fakeCacheableLookupVindex is a Lookup, Reversible, Cacheable,
+// Unique, SingleColumn vindex, used to verify that wrapping it for
+// caching doesn't drop the Lookup/Reversible interfaces.
+type fakeCacheableLookupVindex struct {
+	rows     map[interface{}][]byte
+	mapCalls int
+}
+
+func newFakeCacheableLookupVindex() *fakeCacheableLookupVindex {
+	return &fakeCacheableLookupVindex{rows: make(map[interface{}][]byte)}
+}
+
+func (f *fakeCacheableLookupVindex) String() string { return "fake_cacheable_lookup" }
+func (f *fakeCacheableLookupVindex) Cost() int      { return 2 }
+
+func (f *fakeCacheableLookupVindex) Map(_ VCursor, ids []interface{}) ([][]byte, error) {
+	f.mapCalls++
+	out := make([][]byte, len(ids))
+	for i, id := range ids {
+		out[i] = f.rows[id]
+	}
+	return out, nil
+}
+
+func (f *fakeCacheableLookupVindex) Verify(_ VCursor, id interface{}, ks []byte) (bool, error) {
+	return string(f.rows[id]) == string(ks), nil
+}
+
+func (f *fakeCacheableLookupVindex) CacheKey(id interface{}) string { return id.(string) }
+func (f *fakeCacheableLookupVindex) TTL() time.Duration             { return time.Minute }
+
+func (f *fakeCacheableLookupVindex) Create(_ VCursor, id interface{}, ks []byte) error {
+	f.rows[id] = ks
+	return nil
+}
+
+func (f *fakeCacheableLookupVindex) Delete(_ VCursor, ids []interface{}, _ []byte) error {
+	for _, id := range ids {
+		delete(f.rows, id)
+	}
+	return nil
+}
+
+func (f *fakeCacheableLookupVindex) Update(cursor VCursor, oldID, newID interface{}, ks []byte) error {
+	if err := f.Delete(cursor, []interface{}{oldID}, ks); err != nil {
+		return err
+	}
+	return f.Create(cursor, newID, ks)
+}
+
+func (f *fakeCacheableLookupVindex) ReverseMap(_ VCursor, ks []byte) (interface{}, error) {
+	for id, v := range f.rows {
+		if string(v) == string(ks) {
+			return id, nil
+		}
+	}
+	return nil, nil
+}
+
+// fakeCacheableFunctionalVindex is Cacheable, Unique and
+// SingleColumn only: no Lookup, no Reversible. It's used to check
+// that the cache wrapper doesn't fabricate interfaces the wrapped
+// vindex never had.
+type fakeCacheableFunctionalVindex struct {
+	rows     map[interface{}][]byte
+	mapCalls int
+}
+
+func (f *fakeCacheableFunctionalVindex) String() string { return "fake_cacheable_functional" }
+func (f *fakeCacheableFunctionalVindex) Cost() int      { return 0 }
+
+func (f *fakeCacheableFunctionalVindex) Map(_ VCursor, ids []interface{}) ([][]byte, error) {
+	f.mapCalls++
+	out := make([][]byte, len(ids))
+	for i, id := range ids {
+		out[i] = f.rows[id]
+	}
+	return out, nil
+}
+
+func (f *fakeCacheableFunctionalVindex) Verify(_ VCursor, id interface{}, ks []byte) (bool, error) {
+	return string(f.rows[id]) == string(ks), nil
+}
+
+func (f *fakeCacheableFunctionalVindex) CacheKey(id interface{}) string { return id.(string) }
+func (f *fakeCacheableFunctionalVindex) TTL() time.Duration             { return 0 }
+
+func TestCreateVindexWithCachePreservesLookupAndReversible(t *testing.T) {
+	const vindexType = "test_cacheable_lookup_preserve"
+	Register(vindexType, func(name string, params map[string]interface{}) (Vindex, error) {
+		return newFakeCacheableLookupVindex(), nil
+	})
+
+	v, err := CreateVindex(vindexType, "vname", map[string]interface{}{
+		"cache": map[string]interface{}{},
+	})
+	if err != nil {
+		t.Fatalf("CreateVindex: %v", err)
+	}
+	if _, ok := v.(Unique); !ok {
+		t.Errorf("cached vindex lost the Unique interface")
+	}
+	if _, ok := v.(SingleColumn); !ok {
+		t.Errorf("cached vindex lost the SingleColumn interface")
+	}
+	if _, ok := v.(Lookup); !ok {
+		t.Errorf("cached vindex lost the Lookup interface")
+	}
+	if _, ok := v.(Reversible); !ok {
+		t.Errorf("cached vindex lost the Reversible interface")
+	}
+}
+
+func TestCreateVindexWithCacheDoesNotFabricateOptionalInterfaces(t *testing.T) {
+	const vindexType = "test_cacheable_functional_no_extras"
+	Register(vindexType, func(name string, params map[string]interface{}) (Vindex, error) {
+		return &fakeCacheableFunctionalVindex{rows: map[interface{}][]byte{"x": []byte("ks")}}, nil
+	})
+
+	v, err := CreateVindex(vindexType, "vname", map[string]interface{}{
+		"cache": map[string]interface{}{},
+	})
+	if err != nil {
+		t.Fatalf("CreateVindex: %v", err)
+	}
+	if _, ok := v.(Lookup); ok {
+		t.Errorf("wrapped vindex incorrectly satisfies Lookup, but the wrapped vindex never implemented it")
+	}
+	if _, ok := v.(Reversible); ok {
+		t.Errorf("wrapped vindex incorrectly satisfies Reversible, but the wrapped vindex never implemented it")
+	}
+}
+
+func TestCreateVindexWithCacheServesSecondMapFromCache(t *testing.T) {
+	const vindexType = "test_cacheable_lookup_hit"
+	inner := newFakeCacheableLookupVindex()
+	inner.rows["x"] = []byte("ks")
+	Register(vindexType, func(name string, params map[string]interface{}) (Vindex, error) {
+		return inner, nil
+	})
+
+	v, err := CreateVindex(vindexType, "vname", map[string]interface{}{
+		"cache": map[string]interface{}{},
+	})
+	if err != nil {
+		t.Fatalf("CreateVindex: %v", err)
+	}
+	unique := v.(Unique)
+	if _, err := unique.Map(fakeVCursor{}, []interface{}{"x"}); err != nil {
+		t.Fatalf("Map: %v", err)
+	}
+	if _, err := unique.Map(fakeVCursor{}, []interface{}{"x"}); err != nil {
+		t.Fatalf("Map: %v", err)
+	}
+	if inner.mapCalls != 1 {
+		t.Errorf("underlying Map was called %d times, want 1 (the second Map should hit the cache)", inner.mapCalls)
+	}
+}
+
+func TestInvalidateCacheForcesReMap(t *testing.T) {
+	const vindexType = "test_cacheable_lookup_invalidate"
+	inner := newFakeCacheableLookupVindex()
+	inner.rows["x"] = []byte("ks")
+	Register(vindexType, func(name string, params map[string]interface{}) (Vindex, error) {
+		return inner, nil
+	})
+
+	v, err := CreateVindex(vindexType, "vname", map[string]interface{}{
+		"cache": map[string]interface{}{},
+	})
+	if err != nil {
+		t.Fatalf("CreateVindex: %v", err)
+	}
+	unique := v.(Unique)
+	if _, err := unique.Map(fakeVCursor{}, []interface{}{"x"}); err != nil {
+		t.Fatalf("Map: %v", err)
+	}
+
+	invalidateCache(v, "x")
+
+	if _, err := unique.Map(fakeVCursor{}, []interface{}{"x"}); err != nil {
+		t.Fatalf("Map: %v", err)
+	}
+	if inner.mapCalls != 2 {
+		t.Errorf("underlying Map was called %d times, want 2: invalidateCache should have forced the second Map past the cache", inner.mapCalls)
+	}
+}
+
+func TestInvalidateCacheOnUnwrappedVindexIsANoop(t *testing.T) {
+	v := &fakeFunctionalVindex{cost: 1}
+	// v was never wrapped for caching, so this must not panic and
+	// must simply do nothing.
+	invalidateCache(v, "x")
+}
+
+func TestCachingLookupCreateInvalidatesCache(t *testing.T) {
+	const vindexType = "test_cacheable_lookup_create_invalidates"
+	inner := newFakeCacheableLookupVindex()
+	Register(vindexType, func(name string, params map[string]interface{}) (Vindex, error) {
+		return inner, nil
+	})
+
+	v, err := CreateVindex(vindexType, "vname", map[string]interface{}{
+		"cache": map[string]interface{}{},
+	})
+	if err != nil {
+		t.Fatalf("CreateVindex: %v", err)
+	}
+	unique := v.(Unique)
+	lookup := v.(Lookup)
+
+	// Cache a negative result for "x" before it exists.
+	if _, err := unique.Map(fakeVCursor{}, []interface{}{"x"}); err != nil {
+		t.Fatalf("Map: %v", err)
+	}
+	if inner.mapCalls != 1 {
+		t.Fatalf("underlying Map was called %d times, want 1", inner.mapCalls)
+	}
+
+	if err := lookup.Create(fakeVCursor{}, "x", []byte("ks")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	got, err := unique.Map(fakeVCursor{}, []interface{}{"x"})
+	if err != nil {
+		t.Fatalf("Map: %v", err)
+	}
+	if string(got[0]) != "ks" {
+		t.Errorf("Map after Create returned %q, want %q: Create should have invalidated the stale negative cache entry", got[0], "ks")
+	}
+	if inner.mapCalls != 2 {
+		t.Errorf("underlying Map was called %d times, want 2: the cache entry Create invalidated should force a re-fetch", inner.mapCalls)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package planbuilder
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+// fakeVCursor is a VCursor that never actually talks to a tablet;
+// it's enough to satisfy Lookup and Unique/SingleColumn methods
+// that only need a cursor to pass through.
+type fakeVCursor struct{}
+
+func (fakeVCursor) Execute(query string, bindvars map[string]interface{}) (*sqltypes.Result, error) {
+	return &sqltypes.Result{}, nil
+}
+
+func (fakeVCursor) ExecuteBatch(queries []BoundQuery) ([]*sqltypes.Result, error) {
+	results := make([]*sqltypes.Result, len(queries))
+	for i := range queries {
+		results[i] = &sqltypes.Result{}
+	}
+	return results, nil
+}
+
+// fakeLookup is a minimal Lookup vindex backed by an in-memory map.
+// Its Update is implemented as the delete-then-create pair the
+// Lookup doc comment describes as the baseline behavior.
+type fakeLookup struct {
+	rows map[interface{}][]byte
+}
+
+func newFakeLookup() *fakeLookup {
+	return &fakeLookup{rows: make(map[interface{}][]byte)}
+}
+
+func (f *fakeLookup) Create(_ VCursor, id interface{}, ks []byte) error {
+	f.rows[id] = ks
+	return nil
+}
+
+func (f *fakeLookup) Delete(_ VCursor, ids []interface{}, _ []byte) error {
+	for _, id := range ids {
+		delete(f.rows, id)
+	}
+	return nil
+}
+
+func (f *fakeLookup) Update(cursor VCursor, oldID, newID interface{}, ks []byte) error {
+	if err := f.Delete(cursor, []interface{}{oldID}, ks); err != nil {
+		return err
+	}
+	return f.Create(cursor, newID, ks)
+}
+
+func TestLookupUpdateMatchesDeleteThenCreate(t *testing.T) {
+	var _ Lookup = (*fakeLookup)(nil)
+
+	f := newFakeLookup()
+	cursor := fakeVCursor{}
+	ks := []byte("ks1")
+
+	if err := f.Create(cursor, "old", ks); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := f.Update(cursor, "old", "new", ks); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if _, ok := f.rows["old"]; ok {
+		t.Errorf("Update left the old id in place, want it removed like Delete would")
+	}
+	got, ok := f.rows["new"]
+	if !ok {
+		t.Fatalf("Update did not create the new id")
+	}
+	if !reflect.DeepEqual(got, ks) {
+		t.Errorf("Update stored keyspace id %v, want %v", got, ks)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package planbuilder
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// fakeMultiColumnVindex is a MultiColumn vindex over two columns,
+// backed by an in-memory map keyed by the joined rowid.
+type fakeMultiColumnVindex struct {
+	cols     []string
+	rows     map[string][]byte
+	mapCalls int
+	mapErr   error
+}
+
+func newFakeMultiColumnVindex(cols ...string) *fakeMultiColumnVindex {
+	return &fakeMultiColumnVindex{cols: cols, rows: make(map[string][]byte)}
+}
+
+func (f *fakeMultiColumnVindex) String() string    { return "fake_multi_column" }
+func (f *fakeMultiColumnVindex) Cost() int         { return 1 }
+func (f *fakeMultiColumnVindex) Columns() []string { return f.cols }
+
+func rowKey(rowid []interface{}) string {
+	return fmt.Sprint(rowid)
+}
+
+func (f *fakeMultiColumnVindex) Map(_ VCursor, rowids [][]interface{}) ([][]byte, error) {
+	f.mapCalls++
+	if f.mapErr != nil {
+		return nil, f.mapErr
+	}
+	out := make([][]byte, len(rowids))
+	for i, rowid := range rowids {
+		out[i] = f.rows[rowKey(rowid)]
+	}
+	return out, nil
+}
+
+func (f *fakeMultiColumnVindex) Verify(_ VCursor, rowids [][]interface{}, ks [][]byte) ([]bool, error) {
+	out := make([]bool, len(rowids))
+	for i, rowid := range rowids {
+		out[i] = string(f.rows[rowKey(rowid)]) == string(ks[i])
+	}
+	return out, nil
+}
+
+func TestMapMultiColumnPredicateRoutesOnColumnMatch(t *testing.T) {
+	v := newFakeMultiColumnVindex("a", "b")
+	rowids := [][]interface{}{{1, 2}, {3, 4}}
+	v.rows[rowKey(rowids[0])] = []byte("ks1")
+	v.rows[rowKey(rowids[1])] = []byte("ks2")
+
+	ks, ok, err := MapMultiColumnPredicate(v, fakeVCursor{}, []string{"a", "b"}, rowids)
+	if err != nil {
+		t.Fatalf("MapMultiColumnPredicate: %v", err)
+	}
+	if !ok {
+		t.Fatalf("ok = false, want true for a matching MultiColumn vindex")
+	}
+	want := [][]byte{[]byte("ks1"), []byte("ks2")}
+	if !reflect.DeepEqual(ks, want) {
+		t.Errorf("ks = %v, want %v", ks, want)
+	}
+	if v.mapCalls != 1 {
+		t.Errorf("Map was called %d times, want 1", v.mapCalls)
+	}
+}
+
+func TestMapMultiColumnPredicateFallsBackOnColumnMismatch(t *testing.T) {
+	v := newFakeMultiColumnVindex("a", "b")
+
+	_, ok, err := MapMultiColumnPredicate(v, fakeVCursor{}, []string{"b", "a"}, nil)
+	if err != nil {
+		t.Fatalf("MapMultiColumnPredicate: %v", err)
+	}
+	if ok {
+		t.Errorf("ok = true, want false when the predicate's column order doesn't match Columns()")
+	}
+
+	_, ok, err = MapMultiColumnPredicate(v, fakeVCursor{}, []string{"a"}, nil)
+	if err != nil {
+		t.Fatalf("MapMultiColumnPredicate: %v", err)
+	}
+	if ok {
+		t.Errorf("ok = true, want false when the predicate supplies fewer columns than Columns()")
+	}
+	if v.mapCalls != 0 {
+		t.Errorf("Map was called %d times, want 0: a mismatch must fall back to scatter, not call Map", v.mapCalls)
+	}
+}
+
+func TestMapMultiColumnPredicateFallsBackOnNonMultiColumnVindex(t *testing.T) {
+	v := &fakeFunctionalVindex{cost: 1}
+
+	_, ok, err := MapMultiColumnPredicate(v, fakeVCursor{}, []string{"a"}, nil)
+	if err != nil {
+		t.Fatalf("MapMultiColumnPredicate: %v", err)
+	}
+	if ok {
+		t.Errorf("ok = true, want false for a vindex that isn't MultiColumn")
+	}
+}
+
+func TestMapMultiColumnPredicatePropagatesMapError(t *testing.T) {
+	v := newFakeMultiColumnVindex("a", "b")
+	v.mapErr = fmt.Errorf("lookup failed")
+
+	_, ok, err := MapMultiColumnPredicate(v, fakeVCursor{}, []string{"a", "b"}, [][]interface{}{{1, 2}})
+	if err == nil {
+		t.Fatalf("MapMultiColumnPredicate returned a nil error, want the underlying Map error propagated")
+	}
+	if !ok {
+		t.Errorf("ok = false, want true: the vindex matched, so the error is Map's, not a fallback signal")
+	}
+}
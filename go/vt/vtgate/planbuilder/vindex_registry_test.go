@@ -0,0 +1,199 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package planbuilder
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// fakeFunctionalVindex is Unique and SingleColumn, needs no
+// params to construct, and is Reversible - the shape DescribeVindex
+// can fully probe.
+type fakeFunctionalVindex struct{ cost int }
+
+func (f *fakeFunctionalVindex) String() string { return "fake_functional" }
+func (f *fakeFunctionalVindex) Cost() int      { return f.cost }
+func (f *fakeFunctionalVindex) Map(_ VCursor, ids []interface{}) ([][]byte, error) {
+	return make([][]byte, len(ids)), nil
+}
+func (f *fakeFunctionalVindex) Verify(_ VCursor, _ interface{}, _ []byte) (bool, error) {
+	return true, nil
+}
+func (f *fakeFunctionalVindex) ReverseMap(_ VCursor, _ []byte) (interface{}, error) {
+	return nil, nil
+}
+
+func TestRegisterAndCreateVindex(t *testing.T) {
+	const vindexType = "test_registry_basic"
+	Register(vindexType, func(name string, params map[string]interface{}) (Vindex, error) {
+		return &fakeFunctionalVindex{cost: 1}, nil
+	})
+
+	v, err := CreateVindex(vindexType, "vname", nil)
+	if err != nil {
+		t.Fatalf("CreateVindex: %v", err)
+	}
+	if v.Cost() != 1 {
+		t.Errorf("Cost() = %d, want 1", v.Cost())
+	}
+
+	if _, err := CreateVindex("test_registry_unknown", "vname", nil); err == nil {
+		t.Errorf("CreateVindex with an unregistered type returned nil error")
+	}
+}
+
+func TestRegisterPanicsOnDuplicate(t *testing.T) {
+	const vindexType = "test_registry_duplicate"
+	Register(vindexType, func(name string, params map[string]interface{}) (Vindex, error) {
+		return &fakeFunctionalVindex{}, nil
+	})
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Register with a duplicate vindexType did not panic")
+		}
+	}()
+	Register(vindexType, func(name string, params map[string]interface{}) (Vindex, error) {
+		return &fakeFunctionalVindex{}, nil
+	})
+}
+
+func TestUnregisterRemovesType(t *testing.T) {
+	const vindexType = "test_registry_unregister"
+	Register(vindexType, func(name string, params map[string]interface{}) (Vindex, error) {
+		return &fakeFunctionalVindex{}, nil
+	})
+	Unregister(vindexType)
+
+	if _, err := CreateVindex(vindexType, "vname", nil); err == nil {
+		t.Errorf("CreateVindex succeeded after Unregister")
+	}
+	// Unregistering an already-unregistered (or never registered)
+	// type must be a no-op, not a panic.
+	Unregister(vindexType)
+	Unregister("test_registry_never_registered")
+}
+
+func TestReplaceVindexFuncRequiresExistingRegistration(t *testing.T) {
+	const vindexType = "test_registry_replace_missing"
+	if err := ReplaceVindexFunc(vindexType, func(name string, params map[string]interface{}) (Vindex, error) {
+		return &fakeFunctionalVindex{}, nil
+	}); err == nil {
+		t.Errorf("ReplaceVindexFunc on an unregistered type returned nil error")
+	}
+}
+
+func TestReplaceVindexFuncSwapsImplementation(t *testing.T) {
+	const vindexType = "test_registry_replace"
+	Register(vindexType, func(name string, params map[string]interface{}) (Vindex, error) {
+		return &fakeFunctionalVindex{cost: 1}, nil
+	})
+
+	if err := ReplaceVindexFunc(vindexType, func(name string, params map[string]interface{}) (Vindex, error) {
+		return &fakeFunctionalVindex{cost: 2}, nil
+	}); err != nil {
+		t.Fatalf("ReplaceVindexFunc: %v", err)
+	}
+
+	v, err := CreateVindex(vindexType, "vname", nil)
+	if err != nil {
+		t.Fatalf("CreateVindex: %v", err)
+	}
+	if v.Cost() != 2 {
+		t.Errorf("Cost() = %d after ReplaceVindexFunc, want 2 (the swapped implementation)", v.Cost())
+	}
+}
+
+func TestRegisteredVindexTypesIncludesRegistered(t *testing.T) {
+	const vindexType = "test_registry_list_me"
+	Register(vindexType, func(name string, params map[string]interface{}) (Vindex, error) {
+		return &fakeFunctionalVindex{}, nil
+	})
+
+	found := false
+	for _, got := range RegisteredVindexTypes() {
+		if got == vindexType {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Errorf("RegisteredVindexTypes() does not include %q", vindexType)
+	}
+}
+
+func TestDescribeVindexUnknownType(t *testing.T) {
+	if _, err := DescribeVindex("test_registry_describe_unknown"); err == nil {
+		t.Errorf("DescribeVindex on an unregistered type returned nil error")
+	}
+}
+
+func TestDescribeVindexConstructionError(t *testing.T) {
+	const vindexType = "test_registry_describe_needs_params"
+	Register(vindexType, func(name string, params map[string]interface{}) (Vindex, error) {
+		if params["table"] == nil {
+			return nil, fmt.Errorf("table param required")
+		}
+		return &fakeFunctionalVindex{}, nil
+	})
+
+	if _, err := DescribeVindex(vindexType); err == nil {
+		t.Errorf("DescribeVindex on a vindex that requires params returned nil error")
+	}
+}
+
+func TestDescribeVindexSuccess(t *testing.T) {
+	const vindexType = "test_registry_describe_ok"
+	Register(vindexType, func(name string, params map[string]interface{}) (Vindex, error) {
+		return &fakeFunctionalVindex{cost: 1}, nil
+	})
+
+	info, err := DescribeVindex(vindexType)
+	if err != nil {
+		t.Fatalf("DescribeVindex: %v", err)
+	}
+	if info.Type != vindexType {
+		t.Errorf("Type = %q, want %q", info.Type, vindexType)
+	}
+	if info.Cost != 1 {
+		t.Errorf("Cost = %d, want 1", info.Cost)
+	}
+	if !info.Unique {
+		t.Errorf("Unique = false, want true")
+	}
+	if !info.Reversible {
+		t.Errorf("Reversible = false, want true")
+	}
+	if info.MultiColumn {
+		t.Errorf("MultiColumn = true, want false")
+	}
+}
+
+// TestRegistryMutexConcurrentAccess exercises Register, Unregister
+// and ReplaceVindexFunc from many goroutines at once; run with
+// -race, it catches any access to the registry map left outside
+// registryMu.
+func TestRegistryMutexConcurrentAccess(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			vindexType := fmt.Sprintf("test_registry_concurrent_%d", i)
+			newVindexFunc := func(name string, params map[string]interface{}) (Vindex, error) {
+				return &fakeFunctionalVindex{}, nil
+			}
+			Register(vindexType, newVindexFunc)
+			_ = ReplaceVindexFunc(vindexType, newVindexFunc)
+			_ = RegisteredVindexTypes()
+			_, _ = DescribeVindex(vindexType)
+			Unregister(vindexType)
+		}()
+	}
+	wg.Wait()
+}